@@ -0,0 +1,328 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+	"github.com/TheCacophonyProject/go-config"
+	"github.com/c9s/goprocinfo/linux"
+)
+
+const (
+	defaultBatteryRotateSizeBytes = 10 * 1024 * 1024 // 10MB
+	defaultBatteryRotateKeep      = 5
+	defaultLowBatteryVoltage      = 3.0
+	defaultBrownOutVoltage        = 2.6
+)
+
+// BatteryMonitorConfig controls the sampling interval, alert thresholds and
+// rotation policy for the battery/CPU telemetry subsystem. It is read from
+// go-config so it can be tuned per-device without a rebuild.
+type BatteryMonitorConfig struct {
+	ReadingInterval       time.Duration `mapstructure:"reading-interval"`
+	LowVoltage            float64       `mapstructure:"low-voltage"`
+	BrownOutVoltage       float64       `mapstructure:"brown-out-voltage"`
+	RotateSizeBytes       int64         `mapstructure:"rotate-size-bytes"`
+	RotateKeepGenerations int           `mapstructure:"rotate-keep-generations"`
+}
+
+// DefaultBatteryMonitorConfig returns the config used when go-config has no
+// "battery-monitor" section or fails to parse.
+func DefaultBatteryMonitorConfig() BatteryMonitorConfig {
+	return BatteryMonitorConfig{
+		ReadingInterval:       batteryReadingInterval,
+		LowVoltage:            defaultLowBatteryVoltage,
+		BrownOutVoltage:       defaultBrownOutVoltage,
+		RotateSizeBytes:       defaultBatteryRotateSizeBytes,
+		RotateKeepGenerations: defaultBatteryRotateKeep,
+	}
+}
+
+// LoadBatteryMonitorConfig reads the "battery-monitor" section from the
+// config folder, falling back to DefaultBatteryMonitorConfig on any error.
+// This is deliberately a separate section from go-config's own "battery"
+// section (ADC calibration readings consumed by ReadBatteryVoltage) so the
+// two independently-versioned schemas don't have to share one TOML table.
+func LoadBatteryMonitorConfig(configDir string) BatteryMonitorConfig {
+	conf := DefaultBatteryMonitorConfig()
+	c, err := config.New(configDir)
+	if err != nil {
+		log.Printf("battery monitor: failed to load config, using defaults: %v", err)
+		return conf
+	}
+	if err := c.Unmarshal("battery-monitor", &conf); err != nil {
+		log.Printf("battery monitor: failed to parse battery-monitor config, using defaults: %v", err)
+		return DefaultBatteryMonitorConfig()
+	}
+	return conf
+}
+
+// BatteryMonitor periodically samples the ATtiny's battery ADC channel and
+// the kernel's CPU stats, appends the readings to batteryCSVFile, rotates
+// that file once it grows too large, and raises event-reporter events when
+// the battery gets low or browns out.
+type BatteryMonitor struct {
+	attiny *ATtiny
+	conf   BatteryMonitorConfig
+	stop   chan struct{}
+
+	// attinyMu serializes I2C access to attiny with the D-Bus service's
+	// GetBatteryReading, which godbus may call concurrently from its own
+	// goroutine at any time.
+	attinyMu *sync.Mutex
+
+	prevCPU linux.CPUStat
+	haveCPU bool
+
+	lastState string
+}
+
+// StartBatteryMonitor starts the sampling goroutine and returns a handle
+// that can be used to stop it. attinyMu must be the same mutex passed to
+// StartDBusService so the two don't race on the shared I2C bus.
+func StartBatteryMonitor(attiny *ATtiny, conf BatteryMonitorConfig, attinyMu *sync.Mutex) *BatteryMonitor {
+	m := &BatteryMonitor{attiny: attiny, conf: conf, stop: make(chan struct{}), attinyMu: attinyMu, lastState: "normal"}
+	go m.run()
+	return m
+}
+
+// Stop ends the sampling goroutine.
+func (m *BatteryMonitor) Stop() {
+	close(m.stop)
+}
+
+func (m *BatteryMonitor) run() {
+	ticker := time.NewTicker(m.conf.ReadingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.sample(); err != nil {
+				log.Printf("battery monitor: %v", err)
+			}
+		}
+	}
+}
+
+func (m *BatteryMonitor) sample() error {
+	m.attinyMu.Lock()
+	voltage, err := m.attiny.ReadBatteryVoltage()
+	m.attinyMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to read battery voltage: %v", err)
+	}
+
+	cpuLoad, err := m.cpuLoad()
+	if err != nil {
+		log.Printf("battery monitor: failed to read cpu load: %v", err)
+	}
+
+	now := time.Now()
+	if err := m.appendRow(now, voltage, cpuLoad); err != nil {
+		log.Printf("battery monitor: failed to write csv row: %v", err)
+	}
+	if err := m.rotateIfNeeded(); err != nil {
+		log.Printf("battery monitor: failed to rotate csv: %v", err)
+	}
+
+	m.checkThresholds(voltage)
+	return nil
+}
+
+// cpuLoad returns the fraction of CPU time spent not idle since the
+// previous sample, derived from the deltas between two /proc/stat reads.
+func (m *BatteryMonitor) cpuLoad() (float64, error) {
+	stat, err := linux.ReadStat(systemStatFile)
+	if err != nil {
+		return 0, err
+	}
+	cur := stat.CPUStatAll
+
+	if !m.haveCPU {
+		m.prevCPU = cur
+		m.haveCPU = true
+		return 0, nil
+	}
+
+	prevIdle := m.prevCPU.Idle + m.prevCPU.IOWait
+	curIdle := cur.Idle + cur.IOWait
+	prevTotal := cpuStatTotal(m.prevCPU)
+	curTotal := cpuStatTotal(cur)
+	m.prevCPU = cur
+
+	totalDelta := curTotal - prevTotal
+	if totalDelta == 0 {
+		return 0, nil
+	}
+	idleDelta := curIdle - prevIdle
+	return 1 - float64(idleDelta)/float64(totalDelta), nil
+}
+
+func cpuStatTotal(c linux.CPUStat) uint64 {
+	return c.User + c.Nice + c.System + c.Idle + c.IOWait + c.IRQ + c.SoftIRQ + c.Steal + c.Guest + c.GuestNice
+}
+
+func (m *BatteryMonitor) appendRow(t time.Time, voltage, cpuLoad float64) error {
+	f, err := os.OpenFile(batteryCSVFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	row := []string{
+		t.Format(time.RFC3339),
+		strconv.FormatFloat(voltage, 'f', 3, 64),
+		strconv.FormatFloat(cpuLoad, 'f', 4, 64),
+	}
+	if err := w.Write(row); err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rotateIfNeeded gzips batteryCSVFile once it grows past RotateSizeBytes,
+// shuffling along up to RotateKeepGenerations older gzipped copies.
+func (m *BatteryMonitor) rotateIfNeeded() error {
+	return rotateCSV(batteryCSVFile, m.conf.RotateSizeBytes, m.conf.RotateKeepGenerations)
+}
+
+// rotateCSV gzips path once it grows past maxSizeBytes, shuffling along up
+// to keepGenerations older gzipped copies (path.1.gz is always the newest,
+// path.<keepGenerations>.gz the oldest kept). Split out from
+// (*BatteryMonitor).rotateIfNeeded so the generation-shuffle math can be
+// unit tested without a real /var/log/battery.csv.
+func rotateCSV(path string, maxSizeBytes int64, keepGenerations int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() < maxSizeBytes {
+		return nil
+	}
+
+	for i := keepGenerations - 1; i >= 1; i-- {
+		oldPath := rotatedCSVPath(path, i)
+		newPath := rotatedCSVPath(path, i+1)
+		if _, err := os.Stat(oldPath); err == nil {
+			if err := os.Rename(oldPath, newPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := gzipFile(path, rotatedCSVPath(path, 1)); err != nil {
+		return err
+	}
+	return os.Truncate(path, 0)
+}
+
+func rotatedCSVPath(path string, generation int) string {
+	return fmt.Sprintf("%s.%d.gz", path, generation)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		gw.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// checkThresholds reports an event only on the transition into or out of a
+// threshold band, rather than on every sample that falls within one, so a
+// device sitting in brown-out for a day raises one summarised event instead
+// of flooding the management platform with a duplicate per sample.
+func (m *BatteryMonitor) checkThresholds(voltage float64) {
+	checkThresholdsWithReporter(m, voltage, m.reportEvent)
+}
+
+// checkThresholdsWithReporter holds the debounced-state-transition logic,
+// taking the event reporter as a parameter so the state machine can be
+// unit tested without going through event-reporter/D-Bus.
+func checkThresholdsWithReporter(m *BatteryMonitor, voltage float64, report func(eventType string, voltage float64)) {
+	var state string
+	switch {
+	case voltage <= m.conf.BrownOutVoltage:
+		state = "brown-out"
+	case voltage <= m.conf.LowVoltage:
+		state = "low-battery"
+	default:
+		state = "normal"
+	}
+
+	if state == m.lastState {
+		return
+	}
+	m.lastState = state
+
+	if state != "normal" {
+		report(state, voltage)
+	} else {
+		report("battery-recovered", voltage)
+	}
+}
+
+func (m *BatteryMonitor) reportEvent(eventType string, voltage float64) {
+	err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      eventType,
+		Details: map[string]interface{}{
+			"voltage": voltage,
+		},
+	})
+	if err != nil {
+		log.Printf("battery monitor: failed to report %s event: %v", eventType, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateCSVBelowThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "battery.csv")
+	require.NoError(t, os.WriteFile(path, []byte("small"), 0644))
+
+	require.NoError(t, rotateCSV(path, 1024, 5))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(data))
+	assert.NoFileExists(t, rotatedCSVPath(path, 1))
+}
+
+func TestRotateCSVMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "battery.csv")
+	assert.NoError(t, rotateCSV(path, 1024, 5))
+}
+
+func TestRotateCSVGzipsAndTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "battery.csv")
+	require.NoError(t, os.WriteFile(path, []byte("over the size limit"), 0644))
+
+	require.NoError(t, rotateCSV(path, 4, 5))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	gz, err := os.Open(rotatedCSVPath(path, 1))
+	require.NoError(t, err)
+	defer gz.Close()
+	r, err := gzip.NewReader(gz)
+	require.NoError(t, err)
+	contents, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "over the size limit", string(contents))
+}
+
+func TestRotateCSVShufflesGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "battery.csv")
+	require.NoError(t, os.WriteFile(rotatedCSVPath(path, 1), []byte("gen1"), 0644))
+	require.NoError(t, os.WriteFile(rotatedCSVPath(path, 2), []byte("gen2"), 0644))
+	require.NoError(t, os.WriteFile(path, []byte("fresh, over the size limit"), 0644))
+
+	require.NoError(t, rotateCSV(path, 4, 3))
+
+	gen1, err := os.ReadFile(rotatedCSVPath(path, 2))
+	require.NoError(t, err)
+	assert.Equal(t, "gen1", string(gen1))
+
+	gen2, err := os.ReadFile(rotatedCSVPath(path, 3))
+	require.NoError(t, err)
+	assert.Equal(t, "gen2", string(gen2))
+}
+
+func TestRotateCSVDropsOldestBeyondKeepGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "battery.csv")
+	require.NoError(t, os.WriteFile(rotatedCSVPath(path, 1), []byte("gen1"), 0644))
+	require.NoError(t, os.WriteFile(path, []byte("fresh, over the size limit"), 0644))
+
+	require.NoError(t, rotateCSV(path, 4, 1))
+
+	assert.NoFileExists(t, rotatedCSVPath(path, 2))
+}
+
+func TestBatteryMonitorCheckThresholdsDebouncesRepeatedSamples(t *testing.T) {
+	m := &BatteryMonitor{
+		conf: BatteryMonitorConfig{
+			LowVoltage:      3.0,
+			BrownOutVoltage: 2.6,
+		},
+		lastState: "normal",
+	}
+
+	var reported []string
+	reportFn := func(eventType string, voltage float64) {
+		reported = append(reported, eventType)
+	}
+
+	checkThresholdsWithReporter(m, 3.5, reportFn)
+	checkThresholdsWithReporter(m, 2.5, reportFn)
+	checkThresholdsWithReporter(m, 2.4, reportFn)
+	checkThresholdsWithReporter(m, 2.3, reportFn)
+	checkThresholdsWithReporter(m, 3.5, reportFn)
+
+	assert.Equal(t, []string{"brown-out", "battery-recovered"}, reported)
+}
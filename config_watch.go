@@ -0,0 +1,95 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// configFileName matches the file go-config itself reads out of the
+// config folder.
+const configFileName = "config.toml"
+
+// ConfigWatcher watches the config file for changes so the recording
+// window can be picked up without restarting the process. It goes through
+// viper's own WatchConfig/OnConfigChange (the same library go-config is
+// built on) rather than a second, independent fsnotify watcher, so the
+// atomic rename-based writes a config management tool makes are handled
+// the way viper already expects.
+type ConfigWatcher struct {
+	v *viper.Viper
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// WatchConfig starts watching configDir's config file for changes.
+// Callers wait on Context().Done() alongside their own timers so an
+// in-flight sleep can be cancelled as soon as the config changes, or
+// TriggerReload is called on-demand (e.g. from the D-Bus ReloadConfig
+// method).
+func WatchConfig(configDir string) (*ConfigWatcher, error) {
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(configDir, configFileName))
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cw := &ConfigWatcher{v: v, ctx: ctx, cancel: cancel}
+
+	v.OnConfigChange(func(e fsnotify.Event) {
+		log.Printf("config watcher: %s changed", e.Name)
+		cw.TriggerReload()
+	})
+	v.WatchConfig()
+
+	return cw, nil
+}
+
+// Context returns a context that is cancelled the next time the config
+// changes, or TriggerReload is called directly.
+func (cw *ConfigWatcher) Context() context.Context {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.ctx
+}
+
+// TriggerReload cancels the current context, waking anyone selecting on
+// Context().Done(), then arms a fresh one for the next change.
+func (cw *ConfigWatcher) TriggerReload() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.cancel()
+	cw.ctx, cw.cancel = context.WithCancel(context.Background())
+}
+
+// Close does not stop watching the config file: viper doesn't expose a way
+// to stop the underlying fsnotify watcher it started in WatchConfig, so this
+// is a no-op kept for symmetry with the rest of the subsystem's lifecycle.
+func (cw *ConfigWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,261 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/godbus/dbus/introspect"
+)
+
+const (
+	dbusName = "org.cacophony.ATtinyController"
+	dbusPath = "/org/cacophony/ATtinyController"
+)
+
+const introspectXML = `
+<node>
+	<interface name="org.cacophony.ATtinyController">
+		<method name="StayOnFor">
+			<arg direction="in" type="i" name="minutes"/>
+		</method>
+		<method name="StayOnUntil">
+			<arg direction="in" type="x" name="unixTime"/>
+		</method>
+		<method name="GetCameraState">
+			<arg direction="out" type="s" name="state"/>
+		</method>
+		<method name="GetBatteryReading">
+			<arg direction="out" type="d" name="voltage"/>
+		</method>
+		<method name="RequestShutdownDelay">
+			<arg direction="in" type="s" name="requester"/>
+			<arg direction="in" type="i" name="minutes"/>
+		</method>
+		<method name="ReloadConfig">
+		</method>
+		<method name="RegisterHeartbeat">
+			<arg direction="in" type="s" name="name"/>
+			<arg direction="in" type="i" name="maxStaleSeconds"/>
+		</method>
+		<method name="Heartbeat">
+			<arg direction="in" type="s" name="name"/>
+		</method>
+		<method name="NotifySaltRunning">
+		</method>
+		<signal name="CameraStateChanged">
+			<arg type="s" name="state"/>
+		</signal>
+	</interface>` + introspect.IntrospectDataString + `
+</node>`
+
+// DBusService exposes the controller's state and shutdown coordination over
+// the system bus so peer daemons (thermal-recorder, salt-updater,
+// management-interface) can push back a scheduled power-off without having
+// to poll the ATtiny over I2C themselves.
+type DBusService struct {
+	conn       *dbus.Conn
+	attiny     *ATtiny
+	heartbeats *HeartbeatRegistry
+
+	// attinyMu serializes access to attiny's I2C transactions with the
+	// battery monitor's own sampling goroutine. godbus calls every
+	// exported method in a new goroutine, so without this a peer's
+	// GetBatteryReading could race BatteryMonitor.sample (or another
+	// concurrent GetBatteryReading call) on the same I2C bus.
+	attinyMu *sync.Mutex
+
+	mu              sync.Mutex
+	stayOnUntil     time.Time
+	shutdownDelays  map[string]time.Time
+	lastCameraState string
+
+	reload func()
+}
+
+// SetReloadFunc registers the function called when a peer invokes
+// ReloadConfig over D-Bus. It must be set before ReloadConfig can do
+// anything useful.
+func (s *DBusService) SetReloadFunc(reload func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload = reload
+}
+
+// ReloadConfig asks runMain to re-read the config file immediately, instead
+// of waiting for the next filesystem change notification.
+func (s *DBusService) ReloadConfig() *dbus.Error {
+	s.mu.Lock()
+	reload := s.reload
+	s.mu.Unlock()
+
+	if reload == nil {
+		return dbus.MakeFailedError(fmt.Errorf("config reload is not available"))
+	}
+	reload()
+	return nil
+}
+
+// StartDBusService connects to the system bus and exports the controller's
+// D-Bus interface at dbusPath under dbusName.
+func StartDBusService(attiny *ATtiny, heartbeats *HeartbeatRegistry, attinyMu *sync.Mutex) (*DBusService, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+	}
+
+	s := &DBusService{
+		conn:           conn,
+		attiny:         attiny,
+		heartbeats:     heartbeats,
+		attinyMu:       attinyMu,
+		shutdownDelays: make(map[string]time.Time),
+	}
+
+	if err := conn.Export(s, dbusPath, dbusName); err != nil {
+		return nil, fmt.Errorf("failed to export dbus methods: %v", err)
+	}
+	if err := conn.Export(introspect.Introspectable(introspectXML), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return nil, fmt.Errorf("failed to export dbus introspection: %v", err)
+	}
+
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request dbus name %s: %v", dbusName, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("dbus name %s already taken", dbusName)
+	}
+
+	return s, nil
+}
+
+// StayOnUntilTime returns the latest time the device has been asked to stay
+// powered on until, taking both StayOn requests and outstanding shutdown
+// delays into account.
+func (s *DBusService) StayOnUntilTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest := s.stayOnUntil
+	for _, until := range s.shutdownDelays {
+		if until.After(latest) {
+			latest = until
+		}
+	}
+	return latest
+}
+
+// StayOnFor pushes the stay-on deadline forward by the given number of
+// minutes from now, if that's later than any existing deadline.
+func (s *DBusService) StayOnFor(minutes int) *dbus.Error {
+	return s.stayOnUntilUnix(time.Now().Add(time.Duration(minutes) * time.Minute).Unix())
+}
+
+// StayOnUntil pushes the stay-on deadline forward to the given unix time, if
+// that's later than any existing deadline.
+func (s *DBusService) StayOnUntil(unixTime int64) *dbus.Error {
+	return s.stayOnUntilUnix(unixTime)
+}
+
+func (s *DBusService) stayOnUntilUnix(unixTime int64) *dbus.Error {
+	until := time.Unix(unixTime, 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until.After(s.stayOnUntil) {
+		s.stayOnUntil = until
+		log.Printf("dbus: stay on requested until %s", until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// GetCameraState returns the ATtiny's last read camera state.
+func (s *DBusService) GetCameraState() (string, *dbus.Error) {
+	return s.attiny.CameraState, nil
+}
+
+// GetBatteryReading reads the battery voltage from the ATtiny and returns it.
+func (s *DBusService) GetBatteryReading() (float64, *dbus.Error) {
+	s.attinyMu.Lock()
+	defer s.attinyMu.Unlock()
+
+	reading, err := s.attiny.ReadBatteryVoltage()
+	if err != nil {
+		return 0, dbus.MakeFailedError(err)
+	}
+	return reading, nil
+}
+
+// RequestShutdownDelay lets a named peer service push back the shutdown
+// window. The requester's previous delay is replaced, not accumulated, so a
+// service can keep renewing it with a fresh call as its work continues.
+func (s *DBusService) RequestShutdownDelay(requester string, minutes int) *dbus.Error {
+	until := time.Now().Add(time.Duration(minutes) * time.Minute)
+	s.mu.Lock()
+	s.shutdownDelays[requester] = until
+	s.mu.Unlock()
+	log.Printf("dbus: %s requested shutdown delay until %s", requester, until.Format(time.RFC3339))
+	return nil
+}
+
+// RegisterHeartbeat lets a peer service declare that it will call
+// Heartbeat at least every maxStaleSeconds. The WDT ping loop withholds
+// pings to the ATtiny once this service falls stale only if its name is in
+// the watchdog config's required-heartbeats list; a registered service not
+// on that list is tracked for metrics but never withholds pings.
+func (s *DBusService) RegisterHeartbeat(name string, maxStaleSeconds int) *dbus.Error {
+	s.heartbeats.Register(name, time.Duration(maxStaleSeconds)*time.Second)
+	log.Printf("dbus: %s registered a heartbeat with max stale of %ds", name, maxStaleSeconds)
+	return nil
+}
+
+// Heartbeat records that the named peer service is still alive.
+func (s *DBusService) Heartbeat(name string) *dbus.Error {
+	s.heartbeats.Heartbeat(name)
+	return nil
+}
+
+// NotifySaltRunning tells the controller that a Salt run is in progress, so
+// it must defer any scheduled power-off until the run has had a chance to
+// finish (and, if it restarts this process, to finish after that too).
+func (s *DBusService) NotifySaltRunning() *dbus.Error {
+	NotifySaltRunning()
+	return nil
+}
+
+// NotifyCameraState emits a CameraStateChanged signal if the camera state
+// has changed since the last call, so peers can react without polling I2C.
+func (s *DBusService) NotifyCameraState(state string) {
+	s.mu.Lock()
+	changed := state != s.lastCameraState
+	s.lastCameraState = state
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	err := s.conn.Emit(dbus.ObjectPath(dbusPath), dbusName+".CameraStateChanged", state)
+	if err != nil {
+		log.Printf("failed to emit CameraStateChanged signal: %v", err)
+	}
+}
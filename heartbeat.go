@@ -0,0 +1,169 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/go-config"
+)
+
+const defaultMetricsAddr = ":9101"
+
+// WatchdogConfig lists the peer services that must be heartbeating before
+// the ATtiny's hardware watchdog is allowed to be pinged.
+type WatchdogConfig struct {
+	RequiredHeartbeats []string `mapstructure:"required-heartbeats"`
+	MetricsAddr        string   `mapstructure:"metrics-addr"`
+}
+
+// LoadWatchdogConfig reads the "watchdog" section from the config folder,
+// falling back to sane defaults on any error.
+func LoadWatchdogConfig(configDir string) WatchdogConfig {
+	wc := WatchdogConfig{MetricsAddr: defaultMetricsAddr}
+	c, err := config.New(configDir)
+	if err != nil {
+		log.Printf("heartbeat: failed to load config, using defaults: %v", err)
+		return wc
+	}
+	if err := c.Unmarshal("watchdog", &wc); err != nil {
+		log.Printf("heartbeat: failed to parse watchdog config, using defaults: %v", err)
+		return WatchdogConfig{MetricsAddr: defaultMetricsAddr}
+	}
+	return wc
+}
+
+type heartbeatState struct {
+	maxStale time.Duration
+	lastSeen time.Time
+	missed   uint64
+}
+
+// HeartbeatRegistry tracks liveness heartbeats from peer services
+// (thermal-recorder, management-interface, modemd, ...) so the WDT ping
+// loop can withhold pings when the Pi's userspace has hung, even though
+// the ping goroutine itself is still being scheduled.
+type HeartbeatRegistry struct {
+	mu       sync.Mutex
+	required map[string]bool
+	states   map[string]*heartbeatState
+	lastPing time.Time
+}
+
+// NewHeartbeatRegistry creates a registry that requires each of the given
+// service names to register (which counts as its first heartbeat), and then
+// stay within its max-stale duration, before the WDT can arm. A
+// required service missing at boot correctly fails to arm the WDT.
+func NewHeartbeatRegistry(required []string) *HeartbeatRegistry {
+	req := make(map[string]bool, len(required))
+	for _, name := range required {
+		req[name] = true
+	}
+	return &HeartbeatRegistry{required: req, states: make(map[string]*heartbeatState)}
+}
+
+// Register records that name wants to participate in liveness checks and
+// may go up to maxStale between heartbeats before it's considered hung.
+func (r *HeartbeatRegistry) Register(name string, maxStale time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states[name] = &heartbeatState{maxStale: maxStale, lastSeen: time.Now()}
+}
+
+// Heartbeat records that name checked in just now.
+func (r *HeartbeatRegistry) Heartbeat(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.states[name]
+	if !ok {
+		// A heartbeat arrived before Register; track it anyway so it
+		// shows up in metrics. With no max-stale duration, a required
+		// service tracked this way counts as stale until it registers.
+		s = &heartbeatState{}
+		r.states[name] = s
+	}
+	s.lastSeen = time.Now()
+}
+
+// AllFresh reports whether every required registrant has heartbeated
+// within its max-stale duration.
+func (r *HeartbeatRegistry) AllFresh() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	allFresh := true
+	for name := range r.required {
+		s, ok := r.states[name]
+		if !ok {
+			log.Printf("heartbeat: required service %q has not registered", name)
+			allFresh = false
+			continue
+		}
+		if s.lastSeen.IsZero() || now.Sub(s.lastSeen) > s.maxStale {
+			s.missed++
+			allFresh = false
+			log.Printf("heartbeat: %q is stale, withholding WDT ping", name)
+		}
+	}
+	return allFresh
+}
+
+// RecordPing notes that the ATtiny watchdog was just pinged.
+func (r *HeartbeatRegistry) RecordPing() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastPing = time.Now()
+}
+
+// WriteMetrics renders the registry's counters in Prometheus text
+// exposition format.
+func (r *HeartbeatRegistry) WriteMetrics(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP attiny_heartbeat_missed_total Number of times a registrant's heartbeat was found stale.")
+	fmt.Fprintln(w, "# TYPE attiny_heartbeat_missed_total counter")
+	for name, s := range r.states {
+		fmt.Fprintf(w, "attiny_heartbeat_missed_total{service=%q} %d\n", name, s.missed)
+	}
+
+	fmt.Fprintln(w, "# HELP attiny_watchdog_last_ping_timestamp_seconds Unix time of the last ATtiny watchdog ping.")
+	fmt.Fprintln(w, "# TYPE attiny_watchdog_last_ping_timestamp_seconds gauge")
+	fmt.Fprintf(w, "attiny_watchdog_last_ping_timestamp_seconds %d\n", r.lastPing.Unix())
+}
+
+// ServeMetrics starts a small HTTP server exposing WriteMetrics at
+// /metrics on addr.
+func (r *HeartbeatRegistry) ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		r.WriteMetrics(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("heartbeat: metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatRegistryNoRequiredServicesAlwaysFresh(t *testing.T) {
+	r := NewHeartbeatRegistry(nil)
+	assert.True(t, r.AllFresh())
+}
+
+func TestHeartbeatRegistryMissingRegistrantFailsAtBoot(t *testing.T) {
+	r := NewHeartbeatRegistry([]string{"thermal-recorder"})
+	assert.False(t, r.AllFresh())
+}
+
+func TestHeartbeatRegistryFreshAfterRegisterAndHeartbeat(t *testing.T) {
+	r := NewHeartbeatRegistry([]string{"thermal-recorder"})
+	r.Register("thermal-recorder", time.Minute)
+	assert.True(t, r.AllFresh())
+
+	r.Heartbeat("thermal-recorder")
+	assert.True(t, r.AllFresh())
+}
+
+func TestHeartbeatRegistryStaleBeyondMaxStale(t *testing.T) {
+	r := NewHeartbeatRegistry([]string{"modemd"})
+	r.Register("modemd", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, r.AllFresh())
+}
+
+func TestHeartbeatRegistryMissedCounterIncrementsOnEachStaleCheck(t *testing.T) {
+	r := NewHeartbeatRegistry([]string{"modemd"})
+	r.Register("modemd", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	r.AllFresh()
+	r.AllFresh()
+
+	s := r.states["modemd"]
+	assert.EqualValues(t, 2, s.missed)
+}
+
+func TestHeartbeatRegistryOnlyRequiredServicesGateReadiness(t *testing.T) {
+	r := NewHeartbeatRegistry([]string{"thermal-recorder"})
+	r.Register("thermal-recorder", time.Minute)
+	// An optional service that has never registered must not block
+	// readiness; only services named in the required list do.
+	r.Heartbeat("management-interface")
+
+	assert.True(t, r.AllFresh())
+}
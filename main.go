@@ -44,7 +44,6 @@ var (
 	version = "<not set>"
 
 	mu                 sync.Mutex
-	stayOnUntil        = time.Now()
 	saltCommandWaitEnd = time.Time{}
 )
 
@@ -90,16 +89,49 @@ func runMain() error {
 		return err
 	}
 
+	mu.Lock()
+	saltCommandWaitEnd = loadSaltCommandWaitEnd()
+	mu.Unlock()
+
+	configWatcher, err := WatchConfig(args.ConfigDir)
+	if err != nil {
+		return err
+	}
+	defer configWatcher.Close()
+
 	log.Println("Connecting to ATtiny1616")
 	attiny, err := connectToATtinyWithRetries(0)
 	if err != nil {
 		return err
 	}
 
+	// attinyMu serializes I2C access to attiny between the D-Bus service's
+	// GetBatteryReading and the battery monitor's sampling goroutine, which
+	// otherwise race each other on the shared bus.
+	var attinyMu sync.Mutex
+
+	watchdogConf := LoadWatchdogConfig(args.ConfigDir)
+	heartbeats := NewHeartbeatRegistry(watchdogConf.RequiredHeartbeats)
+	heartbeats.ServeMetrics(watchdogConf.MetricsAddr)
+
+	log.Println("Starting D-Bus service")
+	dbusService, err := StartDBusService(attiny, heartbeats, &attinyMu)
+	if err != nil {
+		return err
+	}
+	dbusService.SetReloadFunc(configWatcher.TriggerReload)
+
+	log.Println("Starting battery telemetry")
+	batteryMonitor := StartBatteryMonitor(attiny, LoadBatteryMonitorConfig(args.ConfigDir), &attinyMu)
+	defer batteryMonitor.Stop()
+
 	log.Println("Setting up WDT pinging")
 	go func() {
 		for {
-			attiny.PingWatchdog()
+			if len(watchdogConf.RequiredHeartbeats) == 0 || heartbeats.AllFresh() {
+				attiny.PingWatchdog()
+				heartbeats.RecordPing()
+			}
 			time.Sleep(time.Second * 5)
 		}
 	}()
@@ -129,19 +161,13 @@ func runMain() error {
 	}
 	log.Println("RTC time:", t.Format(time.RFC3339))
 
-	alarmTime := conf.OnWindow.NextStart()
-	log.Println("Alarm time:", alarmTime.Format(time.RFC3339))
-
-	if err := rtc.SetAlarmTime(AlarmTimeFromTime(alarmTime)); err != nil {
-		return err
-	}
-
-	if err := rtc.SetAlarmEnabled(true); err != nil {
+	if err := armAlarm(rtc, conf); err != nil {
 		return err
 	}
 
 	attiny.ReadCameraState()
 	log.Println(attiny.CameraState)
+	dbusService.NotifyCameraState(attiny.CameraState)
 
 	if args.SkipWait {
 		log.Println("Not waiting initial grace period.")
@@ -152,25 +178,85 @@ func runMain() error {
 
 	// Wait for next power off time if in active window or if window is going to starts in the next 5 minutes
 	if conf.OnWindow.Active() || time.Until(conf.OnWindow.NextStart()) < time.Minute*2 {
-		delayDuration := time.Until(conf.OnWindow.NextEnd())
-		log.Printf("Sleeping for %v until turning off", delayDuration)
-		time.Sleep(delayDuration)
+	waitForPowerOff:
+		for {
+			delayDuration := time.Until(conf.OnWindow.NextEnd())
+			log.Printf("Sleeping for %v until turning off", delayDuration)
+			timer := time.NewTimer(delayDuration)
+			select {
+			case <-timer.C:
+				break waitForPowerOff
+			case <-configWatcher.Context().Done():
+				timer.Stop()
+				log.Println("Config changed, reloading recording window")
+				newConf, err := ParseConfig(args.ConfigDir)
+				if err != nil {
+					log.Printf("failed to reload config: %v", err)
+					continue
+				}
+				conf = newConf
+				if err := armAlarm(rtc, conf); err != nil {
+					log.Printf("failed to re-arm alarm after reload: %v", err)
+				}
+			}
+		}
 		log.Println("Finished waiting for power off")
 		attiny.ReadCameraState()
 		log.Println(attiny.CameraState)
+		dbusService.NotifyCameraState(attiny.CameraState)
+	}
+
+	// Peer services may have asked us to stay on or to delay the shutdown
+	// (e.g. a salt run or a thermal-recorder upload in progress). Honour
+	// the latest of those requests before powering off.
+	reportedSaltDeferral := false
+	for {
+		mu.Lock()
+		saltUntil := saltCommandWaitEnd
+		mu.Unlock()
+
+		until := dbusService.StayOnUntilTime()
+		if saltUntil.After(until) {
+			until = saltUntil
+		}
+		if !time.Now().Before(until) {
+			break
+		}
+		if !saltUntil.IsZero() && saltUntil.Equal(until) && !reportedSaltDeferral {
+			reportSaltDeferral(until)
+			reportedSaltDeferral = true
+		}
+		log.Printf("Shutdown deferred until %s by a stay-on request", until.Format(time.RFC3339))
+		time.Sleep(time.Until(until))
 	}
 
 	attiny.ReadCameraState()
 	log.Println(attiny.CameraState)
+	dbusService.NotifyCameraState(attiny.CameraState)
 	if err := attiny.PoweringOff(); err != nil {
 		return err
 	}
 	attiny.ReadCameraState()
 	log.Println(attiny.CameraState)
+	dbusService.NotifyCameraState(attiny.CameraState)
 	shutdown()
 	return nil
 }
 
+// armAlarm computes the next recording window start from conf and writes
+// it to the PCF9564 alarm register. It's called at startup and again
+// whenever the config is reloaded, so a schedule change takes effect
+// without rebooting the Pi.
+func armAlarm(rtc *PCF9564, conf *Config) error {
+	alarmTime := conf.OnWindow.NextStart()
+	log.Println("Alarm time:", alarmTime.Format(time.RFC3339))
+
+	if err := rtc.SetAlarmTime(AlarmTimeFromTime(alarmTime)); err != nil {
+		return err
+	}
+	return rtc.SetAlarmEnabled(true)
+}
+
 func fromBCD(b byte) int {
 	return int(b&0x0F) + int(b>>4)*10
 }
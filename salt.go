@@ -0,0 +1,114 @@
+/*
+attiny-controller - Communicates with ATtiny microcontroller
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/event-reporter/v3/eventclient"
+)
+
+// saltCommandWaitStateFile persists saltCommandWaitEnd so an in-flight
+// Salt run isn't forgotten across the restart Salt itself may trigger.
+const saltCommandWaitStateFile = "/var/lib/attiny-controller/salt-wait-until.json"
+
+type saltWaitState struct {
+	WaitUntil time.Time `json:"waitUntil"`
+}
+
+// loadSaltCommandWaitEnd restores a persisted saltCommandWaitEnd from disk,
+// returning the zero time if none is stored or it can't be read.
+func loadSaltCommandWaitEnd() time.Time {
+	return loadSaltWaitState(saltCommandWaitStateFile)
+}
+
+// saveSaltCommandWaitEnd persists until to disk.
+func saveSaltCommandWaitEnd(until time.Time) {
+	saveSaltWaitState(saltCommandWaitStateFile, until)
+}
+
+// loadSaltWaitState reads and decodes the wait-until state from path,
+// returning the zero time if none is stored or it can't be read. Split out
+// from loadSaltCommandWaitEnd so the JSON round-trip can be unit tested
+// against a temp file instead of saltCommandWaitStateFile.
+func loadSaltWaitState(path string) time.Time {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("salt: failed to read wait state: %v", err)
+		}
+		return time.Time{}
+	}
+
+	var state saltWaitState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("salt: failed to parse wait state: %v", err)
+		return time.Time{}
+	}
+	return state.WaitUntil
+}
+
+// saveSaltWaitState encodes until and writes it to path.
+func saveSaltWaitState(path string, until time.Time) {
+	data, err := json.Marshal(saltWaitState{WaitUntil: until})
+	if err != nil {
+		log.Printf("salt: failed to encode wait state: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("salt: failed to create state dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Printf("salt: failed to persist wait state: %v", err)
+	}
+}
+
+// NotifySaltRunning sets saltCommandWaitEnd to saltCommandWaitDuration from
+// now and persists it, so a Salt run in progress isn't
+// killed by a scheduled power-off even across a restart Salt itself may
+// trigger.
+func NotifySaltRunning() {
+	mu.Lock()
+	saltCommandWaitEnd = time.Now().Add(saltCommandWaitDuration)
+	until := saltCommandWaitEnd
+	mu.Unlock()
+
+	saveSaltCommandWaitEnd(until)
+	log.Printf("salt: run in progress, deferring shutdown until %s", until.Format(time.RFC3339))
+}
+
+// reportSaltDeferral raises an event-reporter entry so operators can audit
+// why a device stayed on past its scheduled window.
+func reportSaltDeferral(until time.Time) {
+	err := eventclient.AddEvent(eventclient.Event{
+		Timestamp: time.Now(),
+		Type:      "salt-deferred-shutdown",
+		Details: map[string]interface{}{
+			"waitUntil": until.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		log.Printf("salt: failed to report deferred shutdown event: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaltWaitStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "salt-wait-until.json")
+	until := time.Now().Add(30 * time.Minute).Round(time.Second)
+
+	saveSaltWaitState(path, until)
+
+	got := loadSaltWaitState(path)
+	assert.True(t, until.Equal(got), "expected %s, got %s", until, got)
+}
+
+func TestSaltWaitStateMissingFileReturnsZeroTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "does-not-exist.json")
+	assert.True(t, loadSaltWaitState(path).IsZero())
+}
+
+func TestSaltWaitStateCorruptFileReturnsZeroTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "salt-wait-until.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+
+	assert.True(t, loadSaltWaitState(path).IsZero())
+}